@@ -7,13 +7,21 @@
 package starlarkjson // import "go.starlark.net/starlarkjson"
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"math"
+	"math/big"
+	"reflect"
 	"sort"
 	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
 
 	"go.starlark.net/starlark"
 	"go.starlark.net/starlarkstruct"
@@ -25,9 +33,10 @@ import (
 //      encode,
 //      decode,
 //      indent,
+//      encode_indent,
 //   )
 //
-// def encode(x):
+// def encode(x, *, indent=""):
 //
 // The encode function accepts one required positional argument,
 // which it converts to JSON by cases:
@@ -44,15 +53,71 @@ import (
 // An application-defined Starlark value type that implements the
 // standard json.Marshal Go interface defines its own JSON encoding.
 // Encoding any other value yields an error.
+// A self-referential value (e.g. a list appended to itself) is also an
+// error, rather than a stack overflow; non-cyclic but repeated
+// references to the same value (e.g. a diamond-shaped graph) encode
+// fine, since each is just copied out wherever it is reached.
+// The optional keyword-only indent parameter, if non-empty, pretty-
+// prints the output using indent as the unit of indentation, as if by
+// encode(x) followed by indent(...); it does the same work in a
+// single pass.
+// Before any of the above cases, if x has a callable to_json
+// attribute, it is called with no arguments and its string result is
+// spliced into the output verbatim (after checking that it parses as
+// JSON); this lets an application-defined type (e.g. one built with
+// starlarkstruct) control its own encoding without Go code. A
+// Go-backed Starlark value may instead implement the Marshaler
+// interface below for direct, allocation-free access to the encoder.
 //
-// def decode(x):
+// def encode_indent(x, *, prefix="", indent="\t"):
 //
-// The decode function accepts one positional parameter, a JSON string.
-// It returns the Starlark value that the string denotes.
-// - Numbers may be parsed as as int or float, depending on magnitude.
-// - JSON objects are parsed as Starlark dicts.
-// - JSON arrays are parsed as Starlark tuples.
-// Decoding fails if x is not a valid JSON string.
+// encode_indent is a convenience wrapper equivalent to
+// indent(encode(x), prefix=prefix, indent=indent), but without the
+// intermediate parse: it accepts the same positional argument as
+// encode, and the same prefix and indent keyword parameters as indent.
+// Unlike indent, an empty indent yields compact output, and prefix is
+// then ignored.
+//
+// def decode(x, *, object=None, array=None, number=None, schema=None):
+//
+// The decode function accepts one positional parameter, a JSON string,
+// and four optional keyword-only parameters that let the caller control
+// the Starlark types the decoder produces:
+//
+// - object, if not None, is called with one keyword argument per field
+//   to construct the value of each JSON object. It defaults to None,
+//   meaning a JSON object decodes directly to a dict (accepting
+//   duplicate keys, last one wins, as encoding/json does); any callable
+//   accepting keyword arguments works, notably the struct constructor
+//   from starlarkstruct: object=struct decodes objects directly into
+//   struct values (which rejects duplicate keys, since struct fields
+//   are Go struct fields).
+// - array, if not None, is called with a single positional argument, a
+//   tuple of the decoded elements, to construct the value of each JSON
+//   array. It defaults to None, meaning a JSON array decodes directly
+//   to a tuple; pass array=list to get a list instead.
+// - number, if not None, is called with the decoded int or float value
+//   of each JSON number, allowing every number to be forced to a single
+//   type, e.g. number=float.
+// - schema, if not None, is a Starlark value describing the expected
+//   shape of x and overriding object, array, and number at the
+//   positions it covers: a dict maps a field name to the schema for
+//   that field; a single-element list gives the schema to apply to
+//   every element of an array; any other (callable) value is applied
+//   directly to the object, array, or scalar found at that position.
+//   This lets a caller decode straight into typed values without a
+//   separate post-processing pass.
+//
+// decode returns the Starlark value that the JSON string denotes.
+// Decoding fails if x is not a valid JSON string, or if one of the
+// supplied constructors fails or is not callable.
+// When a constructor (object, array, number, or a schema entry)
+// applied to a scalar has a callable from_json attribute, that is
+// called with the scalar instead of calling the constructor itself;
+// this is the decoding counterpart of the encoder's to_json protocol.
+// A Go value used as a constructor may instead implement the
+// Unmarshaler interface below to receive the already-assembled dict,
+// tuple, or scalar directly.
 //
 // def indent(str, *, prefix="", indent="\t"):
 //
@@ -62,141 +127,557 @@ import (
 // and two optional keyword-only string parameters, prefix and indent,
 // that specify a prefix of each new line, and the unit of indentation.
 //
+// def encode_lines(iterable):
+//
+// encode_lines accepts one required positional argument, an iterable
+// of values each acceptable to encode, and returns a string containing
+// the NDJSON (newline-delimited JSON) encoding: each element encoded
+// on its own line, terminated by "\n". It is the streaming-friendly
+// equivalent of "".join([encode(v) + "\n" for v in iterable]), so an
+// empty iterable yields "".
+//
+// def decode_lines(x):
+//
+// decode_lines accepts one required positional argument, a string in
+// NDJSON form, and returns a tuple of the decoded values, one per
+// non-blank line.
+//
 var Module = &starlarkstruct.Module{
 	Name: "json",
 	Members: starlark.StringDict{
-		"encode": starlark.NewBuiltin("json.encode", encode),
-		"decode": starlark.NewBuiltin("json.decode", decode),
-		"indent": starlark.NewBuiltin("json.indent", indent),
+		"encode":        starlark.NewBuiltin("json.encode", encode),
+		"decode":        starlark.NewBuiltin("json.decode", decode),
+		"indent":        starlark.NewBuiltin("json.indent", indent),
+		"encode_indent": starlark.NewBuiltin("json.encode_indent", encodeIndent),
+		"encode_lines":  starlark.NewBuiltin("json.encode_lines", encodeLines),
+		"decode_lines":  starlark.NewBuiltin("json.decode_lines", decodeLines),
 	},
 }
 
 func encode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
 	var x starlark.Value
-	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x); err != nil {
+	var indent string // keyword-only
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"x", &x,
+		"indent?", &indent,
+	); err != nil {
 		return nil, err
 	}
+	if len(args) > 1 {
+		// indent is keyword-only; UnpackArgs does not allow us to
+		// directly express "def encode(x, *, indent="")".
+		return nil, fmt.Errorf("%s: got %d arguments, want at most 1", b.Name(), len(args))
+	}
 
 	buf := new(bytes.Buffer)
+	if err := Encode(buf, x, EncodeOptions{Indent: indent, Thread: thread}); err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return starlark.String(buf.String()), nil
+}
 
-	var quoteSpace [128]byte
-	quote := func(s string) {
-		if goQuoteIsSafe(s) {
-			buf.Write(strconv.AppendQuote(quoteSpace[:0], s))
-		} else {
-			// vanishingly rare for text strings
-			data, _ := json.Marshal(s)
-			buf.Write(data)
+func encodeIndent(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x starlark.Value
+	prefix, indent := "", "\t" // keyword-only
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"x", &x,
+		"prefix?", &prefix,
+		"indent?", &indent,
+	); err != nil {
+		return nil, err
+	}
+	if len(args) > 1 {
+		// prefix and indent are keyword-only; UnpackArgs does not
+		// allow us to directly express
+		// "def encode_indent(x, *, prefix="", indent="\t")".
+		return nil, fmt.Errorf("%s: got %d arguments, want at most 1", b.Name(), len(args))
+	}
+
+	buf := new(bytes.Buffer)
+	if err := Encode(buf, x, EncodeOptions{Prefix: prefix, Indent: indent, Thread: thread}); err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return starlark.String(buf.String()), nil
+}
+
+func encodeLines(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var iterable starlark.Iterable
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &iterable); err != nil {
+		return nil, err
+	}
+	iter := iterable.Iterate()
+	defer iter.Done()
+
+	buf := new(bytes.Buffer)
+	if err := EncodeLines(buf, iter, EncodeOptions{Thread: thread}); err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return starlark.String(buf.String()), nil
+}
+
+func decodeLines(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var str string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &str); err != nil {
+		return nil, err
+	}
+
+	v, err := DecodeLines(thread, strings.NewReader(str), new(DecodeOptions))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return v, nil
+}
+
+// EncodeOptions controls how Encode converts a Starlark value to JSON.
+// The zero value reproduces the behavior of the plain encode builtin:
+// dict keys in iteration order, struct fields sorted, and no
+// indentation.
+type EncodeOptions struct {
+	// SortKeys, if true, emits dict keys in sorted order instead of
+	// dict iteration order. Struct fields have no well-defined
+	// iteration order of their own, so they are always sorted,
+	// regardless of this option.
+	SortKeys bool
+
+	// Indent and Prefix, when Indent is non-empty, pretty-print the
+	// output exactly as json.Indent(Prefix, Indent) would, but in a
+	// single pass over the value instead of encode-then-reparse.
+	// JSON spliced in verbatim (from MarshalerFunc, to_json, or
+	// json.Marshaler) is written as is, without re-indentation.
+	Indent string
+	Prefix string
+
+	// MarshalerFunc, if non-nil, is consulted before any of Encode's
+	// built-in cases for every value in the tree. If it reports
+	// handled, its returned bytes (which must already be valid JSON)
+	// are spliced into the output verbatim. This lets an embedder
+	// intercept application-defined Starlark values without the value
+	// having to implement json.Marshaler itself.
+	MarshalerFunc func(starlark.Value) (data []byte, handled bool, err error)
+
+	// Thread, if non-nil, is used to invoke a value's to_json method
+	// (see the package doc comment). It is required only when the
+	// value being encoded, or one it contains, defines to_json.
+	Thread *starlark.Thread
+}
+
+// Marshaler is implemented by Go-backed Starlark values that want
+// direct access to the streaming Encoder to write their own JSON
+// encoding, rather than building an intermediate []byte the way
+// encoding/json.Marshaler requires.
+type Marshaler interface {
+	MarshalStarlarkJSON(enc *Encoder) error
+}
+
+// Unmarshaler is implemented by a Go value used as a decode factory
+// (DecodeOptions.Object, DecodeOptions.Array, DecodeOptions.Number, or
+// a schema entry) that wants the already-assembled Starlark value (a
+// dict for an object, a tuple for an array, or the scalar itself) to
+// construct its result directly, rather than being invoked through
+// starlark.Call with keyword or positional arguments.
+type Unmarshaler interface {
+	UnmarshalStarlarkJSON(v starlark.Value) (starlark.Value, error)
+}
+
+// byteStringWriter is the subset of bufio.Writer that Encoder needs;
+// an io.Writer that already implements it (e.g. *bytes.Buffer) is used
+// directly, avoiding the extra buffering and the final copy into a
+// bytes.Buffer that a naive implementation would need.
+type byteStringWriter interface {
+	io.Writer
+	io.ByteWriter
+	io.StringWriter
+}
+
+// Encoder writes the JSON encoding of a sequence of Starlark values to
+// an io.Writer, without buffering the whole output in memory.
+type Encoder struct {
+	w        byteStringWriter
+	bw       *bufio.Writer // non-nil iff w wraps a writer needing an explicit Flush
+	opts     EncodeOptions
+	depth    int
+	visiting map[unsafe.Pointer]bool
+}
+
+// NewEncoder returns an Encoder that writes to w using opts.
+func NewEncoder(w io.Writer, opts EncodeOptions) *Encoder {
+	bsw, bw := toByteStringWriter(w)
+	return &Encoder{
+		w:        bsw,
+		bw:       bw,
+		opts:     opts,
+		visiting: make(map[unsafe.Pointer]bool),
+	}
+}
+
+func toByteStringWriter(w io.Writer) (byteStringWriter, *bufio.Writer) {
+	if bsw, ok := w.(byteStringWriter); ok {
+		return bsw, nil
+	}
+	bw := bufio.NewWriter(w)
+	return bw, bw
+}
+
+// Encode writes the JSON encoding of v, flushing any internal
+// buffering before returning.
+func (e *Encoder) Encode(v starlark.Value) error {
+	if err := e.encodeValue(v); err != nil {
+		return err
+	}
+	if e.bw != nil {
+		return e.bw.Flush()
+	}
+	return nil
+}
+
+// Encode writes the JSON encoding of v to w using opts. It is a
+// convenience wrapper around NewEncoder for one-shot use.
+func Encode(w io.Writer, v starlark.Value, opts EncodeOptions) error {
+	return NewEncoder(w, opts).Encode(v)
+}
+
+// EncodeLines writes the NDJSON (newline-delimited JSON) encoding of
+// the values produced by iter to w: each value on its own line,
+// terminated by "\n". Unlike building the whole result as a Starlark
+// string, it never holds more than one encoded value in memory.
+func EncodeLines(w io.Writer, iter starlark.Iterator, opts EncodeOptions) error {
+	e := NewEncoder(w, opts)
+	var elem starlark.Value
+	for iter.Next(&elem) {
+		if err := e.encodeValue(elem); err != nil {
+			return err
+		}
+		if err := e.w.WriteByte('\n'); err != nil {
+			return err
 		}
 	}
+	if e.bw != nil {
+		return e.bw.Flush()
+	}
+	return nil
+}
 
-	var emit func(x starlark.Value) error
-	emit = func(x starlark.Value) error {
-		switch x := x.(type) {
-		case json.Marshaler:
-			// Application-defined starlark.Value types
-			// may define their own JSON encoding.
-			data, err := x.MarshalJSON()
-			if err != nil {
-				return err
-			}
-			buf.Write(data)
+func (e *Encoder) quote(s string) {
+	if goQuoteIsSafe(s) {
+		var quoteSpace [128]byte
+		e.w.Write(strconv.AppendQuote(quoteSpace[:0], s))
+	} else {
+		// vanishingly rare for text strings
+		data, _ := json.Marshal(s)
+		e.w.Write(data)
+	}
+}
 
-		case starlark.NoneType:
-			buf.WriteString("null")
+// newline writes "\n" + Prefix + Indent*e.depth, and is a no-op unless
+// Indent is set.
+func (e *Encoder) newline() error {
+	if e.opts.Indent == "" {
+		return nil
+	}
+	if err := e.w.WriteByte('\n'); err != nil {
+		return err
+	}
+	if e.opts.Prefix != "" {
+		if _, err := e.w.WriteString(e.opts.Prefix); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < e.depth; i++ {
+		if _, err := e.w.WriteString(e.opts.Indent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		case starlark.Bool:
-			fmt.Fprintf(buf, "%t", x)
+// enter records that x is being encoded on the current recursion
+// path, reporting an error if x is already on it (a cycle), so that a
+// self-referential value (e.g. a list appended to itself) is reported
+// as an error instead of overflowing the stack. Leaves (None, bool,
+// int, float, string) never participate, since they can't form
+// cycles; non-cyclic repeated references (e.g. a diamond-shaped
+// graph) encode fine, since leave() clears x again once its subtree
+// is done.
+func (e *Encoder) enter(x starlark.Value) (leave func(), err error) {
+	ptr, ok := identity(x)
+	if !ok {
+		return func() {}, nil
+	}
+	if e.visiting[ptr] {
+		return nil, fmt.Errorf("cycle in JSON structure")
+	}
+	e.visiting[ptr] = true
+	return func() { delete(e.visiting, ptr) }, nil
+}
 
-		case starlark.Int:
-			// JSON imposes no limit on numbers,
-			// but the standard Go decoder may switch to float.
-			fmt.Fprint(buf, x)
+// identity returns an identifier unique to the composite value x
+// (e.g. its underlying list or map header, or its struct pointer).
+// It reports false for values with no stable identity, such as the
+// int/float/string/bool/None leaves.
+func identity(x starlark.Value) (unsafe.Pointer, bool) {
+	switch v := reflect.ValueOf(x); v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Chan, reflect.UnsafePointer:
+		return unsafe.Pointer(v.Pointer()), true
+	default:
+		return nil, false
+	}
+}
 
-		case starlark.Float:
-			if !isFinite(float64(x)) {
-				return fmt.Errorf("cannot encode non-finite float %v", x)
-			}
-			fmt.Fprintf(buf, "%g", x)
+// toJSON implements the to_json protocol: if x has a callable to_json
+// attribute, it is called with no arguments via starlark.Call, and its
+// string result is spliced into the output verbatim, after checking
+// that it parses as JSON. This lets a pure-Starlark type (e.g. one
+// built with starlarkstruct) define its own encoding without Go code.
+func (e *Encoder) toJSON(x starlark.Value) (data []byte, handled bool, err error) {
+	hasAttrs, ok := x.(starlark.HasAttrs)
+	if !ok {
+		return nil, false, nil
+	}
+	fn, err := hasAttrs.Attr("to_json")
+	if err != nil || fn == nil {
+		return nil, false, nil
+	}
+	callable, ok := fn.(starlark.Callable)
+	if !ok {
+		return nil, false, fmt.Errorf("%s.to_json is not callable", x.Type())
+	}
+	if e.opts.Thread == nil {
+		return nil, false, fmt.Errorf("%s.to_json: EncodeOptions.Thread is required to call it", x.Type())
+	}
+	result, err := starlark.Call(e.opts.Thread, callable, nil, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("calling %s.to_json: %v", x.Type(), err)
+	}
+	s, ok := starlark.AsString(result)
+	if !ok {
+		return nil, false, fmt.Errorf("%s.to_json must return a string, got %s", x.Type(), result.Type())
+	}
+	if !json.Valid([]byte(s)) {
+		return nil, false, fmt.Errorf("%s.to_json did not return valid JSON", x.Type())
+	}
+	return []byte(s), true, nil
+}
 
-		case starlark.String:
-			quote(string(x))
+func (e *Encoder) encodeValue(x starlark.Value) error {
+	if e.opts.MarshalerFunc != nil {
+		data, handled, err := e.opts.MarshalerFunc(x)
+		if err != nil {
+			return err
+		}
+		if handled {
+			_, err := e.w.Write(data)
+			return err
+		}
+	}
 
-		case starlark.IterableMapping:
-			// e.g. dict (must have string keys)
-			buf.WriteByte('{')
-			iter := x.Iterate()
-			defer iter.Done()
-			var k starlark.Value
-			for i := 0; iter.Next(&k); i++ {
-				if i > 0 {
-					buf.WriteByte(',')
-				}
-				s, ok := starlark.AsString(k)
-				if !ok {
-					return fmt.Errorf("%s has %s key, want string", x.Type(), k.Type())
-				}
-				v, found, err := x.Get(k)
-				if err != nil || !found {
-					log.Fatalf("internal error: mapping %s has %s among keys but value lookup fails", x.Type(), k)
-				}
+	if m, ok := x.(Marshaler); ok {
+		return m.MarshalStarlarkJSON(e)
+	}
 
-				quote(s)
-				buf.WriteByte(':')
-				if err := emit(v); err != nil {
-					return fmt.Errorf("in %s key %s: %v", x.Type(), k, err)
-				}
+	if data, handled, err := e.toJSON(x); err != nil {
+		return err
+	} else if handled {
+		_, err := e.w.Write(data)
+		return err
+	}
+
+	switch x := x.(type) {
+	case json.Marshaler:
+		// Application-defined starlark.Value types
+		// may define their own JSON encoding.
+		data, err := x.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		_, err = e.w.Write(data)
+		return err
+
+	case starlark.NoneType:
+		_, err := e.w.WriteString("null")
+		return err
+
+	case starlark.Bool:
+		s := "false"
+		if x {
+			s = "true"
+		}
+		_, err := e.w.WriteString(s)
+		return err
+
+	case starlark.Int:
+		// JSON imposes no limit on numbers,
+		// but the standard Go decoder may switch to float.
+		_, err := e.w.WriteString(x.String())
+		return err
+
+	case starlark.Float:
+		if !isFinite(float64(x)) {
+			return fmt.Errorf("cannot encode non-finite float %v", x)
+		}
+		_, err := e.w.WriteString(fmt.Sprintf("%g", x))
+		return err
+
+	case starlark.String:
+		e.quote(string(x))
+		return nil
+
+	case starlark.IterableMapping:
+		// e.g. dict (must have string keys)
+		leave, err := e.enter(x)
+		if err != nil {
+			return err
+		}
+		defer leave()
+
+		type field struct {
+			key string
+			val starlark.Value
+		}
+		var fields []field
+		iter := x.Iterate()
+		var k starlark.Value
+		for iter.Next(&k) {
+			s, ok := starlark.AsString(k)
+			if !ok {
+				iter.Done()
+				return fmt.Errorf("%s has %s key, want string", x.Type(), k.Type())
+			}
+			v, found, err := x.Get(k)
+			if err != nil || !found {
+				log.Fatalf("internal error: mapping %s has %s among keys but value lookup fails", x.Type(), k)
 			}
-			buf.WriteByte('}')
-
-		case starlark.Iterable:
-			// e.g. tuple, list
-			buf.WriteByte('[')
-			iter := x.Iterate()
-			defer iter.Done()
-			var elem starlark.Value
-			for i := 0; iter.Next(&elem); i++ {
-				if i > 0 {
-					buf.WriteByte(',')
+			fields = append(fields, field{s, v})
+		}
+		iter.Done()
+		if e.opts.SortKeys {
+			sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+		}
+
+		if err := e.w.WriteByte('{'); err != nil {
+			return err
+		}
+		e.depth++
+		for i, f := range fields {
+			if i > 0 {
+				if err := e.w.WriteByte(','); err != nil {
+					return err
 				}
-				if err := emit(elem); err != nil {
-					return fmt.Errorf("at %s index %d: %v", x.Type(), i, err)
+			}
+			if err := e.newline(); err != nil {
+				return err
+			}
+			e.quote(f.key)
+			if err := e.w.WriteByte(':'); err != nil {
+				return err
+			}
+			if e.opts.Indent != "" {
+				if err := e.w.WriteByte(' '); err != nil {
+					return err
 				}
 			}
-			buf.WriteByte(']')
-
-		case starlark.HasAttrs:
-			// e.g. struct
-			buf.WriteByte('{')
-			var names []string
-			names = append(names, x.AttrNames()...)
-			sort.Strings(names)
-			for i, name := range names {
-				v, err := x.Attr(name)
-				if err != nil || v == nil {
-					log.Fatalf("internal error: dir(%s) includes %q but value has no .%s field", x.Type(), name, name)
+			if err := e.encodeValue(f.val); err != nil {
+				return fmt.Errorf("in %s key %s: %v", x.Type(), f.key, err)
+			}
+		}
+		e.depth--
+		if len(fields) > 0 {
+			if err := e.newline(); err != nil {
+				return err
+			}
+		}
+		return e.w.WriteByte('}')
+
+	case starlark.Iterable:
+		// e.g. tuple, list
+		leave, err := e.enter(x)
+		if err != nil {
+			return err
+		}
+		defer leave()
+
+		if err := e.w.WriteByte('['); err != nil {
+			return err
+		}
+		e.depth++
+		iter := x.Iterate()
+		defer iter.Done()
+		var elem starlark.Value
+		n := 0
+		for iter.Next(&elem) {
+			if n > 0 {
+				if err := e.w.WriteByte(','); err != nil {
+					return err
 				}
-				if i > 0 {
-					buf.WriteByte(',')
+			}
+			if err := e.newline(); err != nil {
+				return err
+			}
+			if err := e.encodeValue(elem); err != nil {
+				return fmt.Errorf("at %s index %d: %v", x.Type(), n, err)
+			}
+			n++
+		}
+		e.depth--
+		if n > 0 {
+			if err := e.newline(); err != nil {
+				return err
+			}
+		}
+		return e.w.WriteByte(']')
+
+	case starlark.HasAttrs:
+		// e.g. struct
+		leave, err := e.enter(x)
+		if err != nil {
+			return err
+		}
+		defer leave()
+
+		var names []string
+		names = append(names, x.AttrNames()...)
+		sort.Strings(names)
+
+		if err := e.w.WriteByte('{'); err != nil {
+			return err
+		}
+		e.depth++
+		for i, name := range names {
+			v, err := x.Attr(name)
+			if err != nil || v == nil {
+				log.Fatalf("internal error: dir(%s) includes %q but value has no .%s field", x.Type(), name, name)
+			}
+			if i > 0 {
+				if err := e.w.WriteByte(','); err != nil {
+					return err
 				}
-				quote(name)
-				buf.WriteByte(':')
-				if err := emit(v); err != nil {
-					return fmt.Errorf("in field .%s: %v", name, err)
+			}
+			if err := e.newline(); err != nil {
+				return err
+			}
+			e.quote(name)
+			if err := e.w.WriteByte(':'); err != nil {
+				return err
+			}
+			if e.opts.Indent != "" {
+				if err := e.w.WriteByte(' '); err != nil {
+					return err
 				}
 			}
-			buf.WriteByte('}')
-
-		default:
-			return fmt.Errorf("cannot encode %s as JSON", x.Type())
+			if err := e.encodeValue(v); err != nil {
+				return fmt.Errorf("in field .%s: %v", name, err)
+			}
 		}
-		return nil
-	}
+		e.depth--
+		if len(names) > 0 {
+			if err := e.newline(); err != nil {
+				return err
+			}
+		}
+		return e.w.WriteByte('}')
 
-	if err := emit(x); err != nil {
-		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	default:
+		return fmt.Errorf("cannot encode %s as JSON", x.Type())
 	}
-	return starlark.String(buf.String()), nil
 }
 
 func goQuoteIsSafe(s string) bool {
@@ -230,61 +711,557 @@ func indent(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, k
 	return starlark.String(buf.String()), nil
 }
 
-func decode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	var str string
-	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &str); err != nil {
+// DecodeOptions controls the Starlark types that Decode produces for a
+// JSON value. The zero value decodes objects to dicts and arrays to
+// tuples, leaving both Object and Array nil.
+type DecodeOptions struct {
+	// Object, if non-nil, is called with one keyword argument per
+	// field to construct the value of each JSON object. If nil, a
+	// JSON object decodes directly to a dict built with SetKey, so
+	// duplicate keys behave as they do for any Starlark dict literal
+	// (last one wins); pass the dict builtin to route objects through
+	// starlark.Call instead, which rejects duplicate keyword arguments.
+	Object starlark.Value
+
+	// Array, if non-nil, is called with a single positional argument,
+	// a tuple of the decoded elements, to construct the value of each
+	// JSON array. If nil, a JSON array decodes directly to that tuple;
+	// pass the list builtin to get a list instead.
+	Array starlark.Value
+
+	// Number, if non-nil, is called with the decoded int or float
+	// value of each JSON number.
+	Number starlark.Value
+
+	// Schema, if non-nil, describes the expected shape of the input
+	// and overrides Object, Array, and Number at the positions it
+	// covers. See the doc comment on the decode builtin for its shape.
+	Schema starlark.Value
+}
+
+// Decode parses the JSON encoding of data and returns the Starlark value
+// it denotes, using opts to control which Starlark types are produced.
+// A nil opts is equivalent to a zero DecodeOptions.
+// Factories named by opts are invoked with starlark.Call on thread, so
+// that they may allocate and charge execution steps like any other
+// Starlark call.
+//
+// Decode scans data itself rather than round-tripping through
+// encoding/json, so JSON integers of arbitrary magnitude are preserved
+// exactly as starlark.Int, and parse errors report the byte offset and
+// line/column at which they occur.
+func Decode(thread *starlark.Thread, data []byte, opts *DecodeOptions) (starlark.Value, error) {
+	if opts == nil {
+		opts = new(DecodeOptions)
+	}
+	d := &decoder{thread: thread, opts: opts, data: data}
+	d.skipSpace()
+	v, err := d.scanValue(opts.Schema)
+	if err != nil {
+		return nil, err
+	}
+	d.skipSpace()
+	if d.pos < len(d.data) {
+		return nil, d.errorf(d.pos, "unexpected character %q after top-level value", d.data[d.pos])
+	}
+	return v, nil
+}
+
+// DecodeLines reads r as NDJSON (newline-delimited JSON): it decodes
+// each non-blank line with Decode using opts, and returns the tuple of
+// decoded values. It never buffers more than one line of r in memory
+// at a time.
+func DecodeLines(thread *starlark.Thread, r io.Reader, opts *DecodeOptions) (starlark.Value, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 64*1024), 1<<30) // JSON lines may exceed bufio's 64KiB default
+	var values starlark.Tuple
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		v, err := Decode(thread, line, opts)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		values = append(values, v)
+	}
+	if err := sc.Err(); err != nil {
 		return nil, err
 	}
+	return values, nil
+}
 
-	// TODO(adonovan): design a mechanism whereby the caller can
-	// control the types instantiated by the decoder (e.g. list
-	// instead of tuple, or struct instead of dict; or any type that
-	// satisfies json.Unmarshaller).
+// decoder is a recursive-descent scanner over a JSON byte string. It
+// builds Starlark values directly, without an intermediate
+// interface{} tree, applying the factories and schema recorded in
+// opts as it goes.
+type decoder struct {
+	thread *starlark.Thread
+	opts   *DecodeOptions
+	data   []byte
+	pos    int
+}
 
-	// This implementation is just a sketch.
-	// TODO(adonovan) reimplement it independent of the Go decoder.
-	// For example, we could decode large integers to bigint, not float.
-	var x interface{}
-	if err := json.Unmarshal([]byte(str), &x); err != nil {
-		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+// errorf reports a scanning error at the given byte offset, annotated
+// with the 1-based line and column it falls on.
+func (d *decoder) errorf(pos int, format string, args ...interface{}) error {
+	line, col := 1, 1
+	for _, b := range d.data[:pos] {
+		if b == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
 	}
-	var decode func(x interface{}) (starlark.Value, error)
-	decode = func(x interface{}) (starlark.Value, error) {
-		switch x := x.(type) {
-		case nil:
-			return starlark.None, nil
-		case bool:
-			return starlark.Bool(x), nil
-		case int:
-			return starlark.MakeInt(x), nil
-		case float64:
-			return starlark.Float(x), nil
-		case string:
-			return starlark.String(x), nil
-		case map[string]interface{}: // object
-			dict := new(starlark.Dict)
-			for k, v := range x {
-				vv, err := decode(v)
-				if err != nil {
-					return nil, fmt.Errorf("in object field .%s, %v", k, err)
-				}
-				dict.SetKey(starlark.String(k), vv) // can't fail
+	return fmt.Errorf("at offset %d (line %d, column %d): %s", pos, line, col, fmt.Sprintf(format, args...))
+}
+
+func (d *decoder) skipSpace() {
+	for d.pos < len(d.data) {
+		switch d.data[d.pos] {
+		case ' ', '\t', '\n', '\r':
+			d.pos++
+		default:
+			return
+		}
+	}
+}
+
+// literal consumes lit (e.g. "true") at the current position, or
+// reports an error.
+func (d *decoder) literal(lit string) error {
+	if d.pos+len(lit) > len(d.data) || string(d.data[d.pos:d.pos+len(lit)]) != lit {
+		return d.errorf(d.pos, "invalid character (expected %s)", lit)
+	}
+	d.pos += len(lit)
+	return nil
+}
+
+// scanValue scans one JSON value at the current position and converts
+// it to a Starlark value, applying schema (which may be nil) at this
+// position.
+func (d *decoder) scanValue(schema starlark.Value) (starlark.Value, error) {
+	d.skipSpace()
+	if d.pos >= len(d.data) {
+		return nil, d.errorf(d.pos, "unexpected end of JSON input")
+	}
+	switch c := d.data[d.pos]; {
+	case c == '{':
+		return d.scanObject(schema)
+	case c == '[':
+		return d.scanArray(schema)
+	case c == '"':
+		s, err := d.scanString()
+		if err != nil {
+			return nil, err
+		}
+		return d.leaf(starlark.String(s), schema)
+	case c == 't':
+		if err := d.literal("true"); err != nil {
+			return nil, err
+		}
+		return d.leaf(starlark.Bool(true), schema)
+	case c == 'f':
+		if err := d.literal("false"); err != nil {
+			return nil, err
+		}
+		return d.leaf(starlark.Bool(false), schema)
+	case c == 'n':
+		if err := d.literal("null"); err != nil {
+			return nil, err
+		}
+		return d.leaf(starlark.None, schema)
+	case c == '-' || ('0' <= c && c <= '9'):
+		return d.scanNumber(schema)
+	default:
+		return nil, d.errorf(d.pos, "unexpected character %q", c)
+	}
+}
+
+// leaf applies a schema callable, if any, to a scalar value.
+func (d *decoder) leaf(v starlark.Value, schema starlark.Value) (starlark.Value, error) {
+	if isNoneOrNil(schema) {
+		return v, nil
+	}
+	return d.callLeaf(schema, v)
+}
+
+// callLeaf constructs a value from the scalar v using fn: if fn has a
+// callable from_json attribute, that is invoked with v (the symmetric
+// counterpart of the to_json encoding protocol); otherwise fn itself
+// is applied to v as in d.call.
+func (d *decoder) callLeaf(fn starlark.Value, v starlark.Value) (starlark.Value, error) {
+	if hasAttrs, ok := fn.(starlark.HasAttrs); ok {
+		if attr, err := hasAttrs.Attr("from_json"); err == nil && attr != nil {
+			callable, ok := attr.(starlark.Callable)
+			if !ok {
+				return nil, fmt.Errorf("%s.from_json is not callable", fn.Type())
 			}
-			return dict, nil
-		case []interface{}: // array
-			tuple := make(starlark.Tuple, len(x))
-			for i, v := range x {
-				vv, err := decode(v)
+			return starlark.Call(d.thread, callable, starlark.Tuple{v}, nil)
+		}
+	}
+	return d.call(fn, starlark.Tuple{v}, nil)
+}
+
+// scanNumber scans a JSON number literal. A literal containing '.',
+// 'e', or 'E' becomes a starlark.Float; otherwise it is parsed as a
+// starlark.Int of arbitrary magnitude.
+func (d *decoder) scanNumber(schema starlark.Value) (starlark.Value, error) {
+	start := d.pos
+	isFloat := false
+
+	if d.pos < len(d.data) && d.data[d.pos] == '-' {
+		d.pos++
+	}
+	if d.pos >= len(d.data) || d.data[d.pos] < '0' || d.data[d.pos] > '9' {
+		return nil, d.errorf(start, "invalid number")
+	}
+	if d.data[d.pos] == '0' {
+		d.pos++
+	} else {
+		d.scanDigits()
+	}
+	if d.pos < len(d.data) && d.data[d.pos] == '.' {
+		isFloat = true
+		d.pos++
+		if d.pos >= len(d.data) || d.data[d.pos] < '0' || d.data[d.pos] > '9' {
+			return nil, d.errorf(d.pos, "invalid number: expected digit after '.'")
+		}
+		d.scanDigits()
+	}
+	if d.pos < len(d.data) && (d.data[d.pos] == 'e' || d.data[d.pos] == 'E') {
+		isFloat = true
+		d.pos++
+		if d.pos < len(d.data) && (d.data[d.pos] == '+' || d.data[d.pos] == '-') {
+			d.pos++
+		}
+		if d.pos >= len(d.data) || d.data[d.pos] < '0' || d.data[d.pos] > '9' {
+			return nil, d.errorf(d.pos, "invalid number: expected digit in exponent")
+		}
+		d.scanDigits()
+	}
+	lit := string(d.data[start:d.pos])
+
+	var v starlark.Value
+	if isFloat {
+		f, err := strconv.ParseFloat(lit, 64)
+		if err != nil {
+			return nil, d.errorf(start, "invalid number literal %q: %v", lit, err)
+		}
+		v = starlark.Float(f)
+	} else {
+		bi, ok := new(big.Int).SetString(lit, 10)
+		if !ok {
+			return nil, d.errorf(start, "invalid integer literal %q", lit)
+		}
+		v = starlark.MakeBigInt(bi)
+	}
+
+	if !isNoneOrNil(schema) {
+		return d.callLeaf(schema, v)
+	}
+	if !isNoneOrNil(d.opts.Number) {
+		return d.callLeaf(d.opts.Number, v)
+	}
+	return v, nil
+}
+
+func (d *decoder) scanDigits() {
+	for d.pos < len(d.data) && d.data[d.pos] >= '0' && d.data[d.pos] <= '9' {
+		d.pos++
+	}
+}
+
+// scanString scans a JSON string literal, validating UTF-8 and
+// resolving \uXXXX escapes (including surrogate pairs) to the Go
+// string it denotes.
+func (d *decoder) scanString() (string, error) {
+	start := d.pos
+	d.pos++ // consume opening quote
+	var buf []byte
+	rawStart := d.pos
+	for {
+		if d.pos >= len(d.data) {
+			return "", d.errorf(start, "unterminated string")
+		}
+		switch c := d.data[d.pos]; {
+		case c == '"':
+			if buf == nil {
+				s := string(d.data[rawStart:d.pos])
+				d.pos++
+				return s, nil
+			}
+			buf = append(buf, d.data[rawStart:d.pos]...)
+			d.pos++
+			return string(buf), nil
+
+		case c == '\\':
+			buf = append(buf, d.data[rawStart:d.pos]...)
+			d.pos++
+			if d.pos >= len(d.data) {
+				return "", d.errorf(start, "unterminated string")
+			}
+			switch esc := d.data[d.pos]; esc {
+			case '"', '\\', '/':
+				buf = append(buf, esc)
+				d.pos++
+			case 'b':
+				buf = append(buf, '\b')
+				d.pos++
+			case 'f':
+				buf = append(buf, '\f')
+				d.pos++
+			case 'n':
+				buf = append(buf, '\n')
+				d.pos++
+			case 'r':
+				buf = append(buf, '\r')
+				d.pos++
+			case 't':
+				buf = append(buf, '\t')
+				d.pos++
+			case 'u':
+				r, err := d.scanUnicodeEscape()
 				if err != nil {
-					return nil, fmt.Errorf("at array index %d, %v", i, err)
+					return "", err
 				}
-				tuple[i] = vv
+				var enc [utf8.UTFMax]byte
+				n := utf8.EncodeRune(enc[:], r)
+				buf = append(buf, enc[:n]...)
+			default:
+				return "", d.errorf(d.pos, "invalid escape character %q", esc)
+			}
+			rawStart = d.pos
+
+		case c < 0x20:
+			return "", d.errorf(d.pos, "invalid control character %q in string", c)
+
+		default:
+			r, size := utf8.DecodeRune(d.data[d.pos:])
+			if r == utf8.RuneError && size <= 1 {
+				return "", d.errorf(d.pos, "invalid UTF-8 in string")
+			}
+			d.pos += size
+		}
+	}
+}
+
+// scanUnicodeEscape scans a \uXXXX escape, with d.pos positioned at
+// the 'u', combining it with an immediately following low surrogate
+// \uXXXX escape if the first denotes a high surrogate.
+func (d *decoder) scanUnicodeEscape() (rune, error) {
+	d.pos++ // consume 'u'
+	r1, err := d.hex4()
+	if err != nil {
+		return 0, err
+	}
+	if utf16.IsSurrogate(rune(r1)) && d.pos+1 < len(d.data) && d.data[d.pos] == '\\' && d.data[d.pos+1] == 'u' {
+		save := d.pos
+		d.pos += 2
+		if r2, err := d.hex4(); err == nil {
+			if dec := utf16.DecodeRune(rune(r1), rune(r2)); dec != utf8.RuneError {
+				return dec, nil
 			}
-			return tuple, nil
 		}
-		panic(x) // unreachable
+		d.pos = save
 	}
-	v, err := decode(x)
+	return rune(r1), nil
+}
+
+func (d *decoder) hex4() (int, error) {
+	if d.pos+4 > len(d.data) {
+		return 0, d.errorf(d.pos, "invalid \\u escape")
+	}
+	v, err := strconv.ParseUint(string(d.data[d.pos:d.pos+4]), 16, 32)
+	if err != nil {
+		return 0, d.errorf(d.pos, "invalid \\u escape")
+	}
+	d.pos += 4
+	return int(v), nil
+}
+
+func (d *decoder) scanObject(schema starlark.Value) (starlark.Value, error) {
+	factory := d.opts.Object
+	fieldSchema := func(string) starlark.Value { return nil }
+	switch s := schema.(type) {
+	case nil, starlark.NoneType:
+		// no schema at this position: fall through to opts.Object
+	case *starlark.Dict:
+		fieldSchema = func(name string) starlark.Value {
+			v, found, _ := s.Get(starlark.String(name))
+			if !found {
+				return nil
+			}
+			return v
+		}
+	default:
+		// a bare callable overrides the object factory for this subtree
+		factory = schema
+	}
+
+	start := d.pos
+	d.pos++ // consume '{'
+	var kwargs []starlark.Tuple
+	d.skipSpace()
+	if d.pos < len(d.data) && d.data[d.pos] == '}' {
+		d.pos++
+	} else {
+		for {
+			d.skipSpace()
+			if d.pos >= len(d.data) || d.data[d.pos] != '"' {
+				return nil, d.errorf(d.pos, "expected string object key")
+			}
+			name, err := d.scanString()
+			if err != nil {
+				return nil, err
+			}
+			d.skipSpace()
+			if d.pos >= len(d.data) || d.data[d.pos] != ':' {
+				return nil, d.errorf(d.pos, "expected ':' after object key")
+			}
+			d.pos++
+			v, err := d.scanValue(fieldSchema(name))
+			if err != nil {
+				return nil, fmt.Errorf("in object field .%s: %v", name, err)
+			}
+			kwargs = append(kwargs, starlark.Tuple{starlark.String(name), v})
+
+			d.skipSpace()
+			if d.pos >= len(d.data) {
+				return nil, d.errorf(start, "unterminated object")
+			}
+			if d.data[d.pos] == ',' {
+				d.pos++
+				continue
+			}
+			if d.data[d.pos] == '}' {
+				d.pos++
+				break
+			}
+			return nil, d.errorf(d.pos, "expected ',' or '}' in object")
+		}
+	}
+
+	if isNoneOrNil(factory) {
+		dict := new(starlark.Dict)
+		for _, kv := range kwargs {
+			dict.SetKey(kv[0], kv[1]) // can't fail
+		}
+		return dict, nil
+	}
+	return d.call(factory, nil, kwargs)
+}
+
+func (d *decoder) scanArray(schema starlark.Value) (starlark.Value, error) {
+	factory := d.opts.Array
+	var elemSchema starlark.Value
+	switch s := schema.(type) {
+	case nil, starlark.NoneType:
+		// no schema at this position: fall through to opts.Array
+	case *starlark.List:
+		if s.Len() > 0 {
+			elemSchema = s.Index(0)
+		}
+	default:
+		// a bare callable overrides the array factory for this subtree
+		factory = schema
+	}
+
+	start := d.pos
+	d.pos++ // consume '['
+	var elems starlark.Tuple
+	d.skipSpace()
+	if d.pos < len(d.data) && d.data[d.pos] == ']' {
+		d.pos++
+	} else {
+		for {
+			v, err := d.scanValue(elemSchema)
+			if err != nil {
+				return nil, fmt.Errorf("at array index %d: %v", len(elems), err)
+			}
+			elems = append(elems, v)
+
+			d.skipSpace()
+			if d.pos >= len(d.data) {
+				return nil, d.errorf(start, "unterminated array")
+			}
+			if d.data[d.pos] == ',' {
+				d.pos++
+				continue
+			}
+			if d.data[d.pos] == ']' {
+				d.pos++
+				break
+			}
+			return nil, d.errorf(d.pos, "expected ',' or ']' in array")
+		}
+	}
+
+	if isNoneOrNil(factory) {
+		// No array factory at this position: the native, fastest-path
+		// result is the tuple of elements itself, not a copy of it
+		// wrapped in anything else.
+		return elems, nil
+	}
+	return d.call(factory, starlark.Tuple{elems}, nil)
+}
+
+func (d *decoder) call(fn starlark.Value, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if u, ok := fn.(Unmarshaler); ok {
+		return u.UnmarshalStarlarkJSON(naturalValue(args, kwargs))
+	}
+	call, ok := fn.(starlark.Callable)
+	if !ok {
+		return nil, fmt.Errorf("got %s, want callable", fn.Type())
+	}
+	return starlark.Call(d.thread, call, args, kwargs)
+}
+
+// naturalValue reassembles the dict, tuple, or scalar that d.call
+// would otherwise pass to fn through starlark.Call, for the benefit of
+// an Unmarshaler, which takes it directly instead.
+func naturalValue(args starlark.Tuple, kwargs []starlark.Tuple) starlark.Value {
+	if len(args) == 1 && len(kwargs) == 0 {
+		return args[0] // a scalar, or the tuple of array elements
+	}
+	dict := new(starlark.Dict)
+	for _, kv := range kwargs {
+		dict.SetKey(kv[0], kv[1]) // can't fail
+	}
+	return dict
+}
+
+func isNoneOrNil(v starlark.Value) bool {
+	return v == nil || v == starlark.None
+}
+
+func decode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var str string
+	var object, array, number, schema starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"x", &str,
+		"object?", &object,
+		"array?", &array,
+		"number?", &number,
+		"schema?", &schema,
+	); err != nil {
+		return nil, err
+	}
+	if len(args) > 1 {
+		// object, array, number, and schema are keyword-only;
+		// UnpackArgs does not allow us to directly express
+		// "def decode(x, *, object=None, array=None, number=None, schema=None)".
+		return nil, fmt.Errorf("%s: got %d arguments, want at most 1", b.Name(), len(args))
+	}
+
+	v, err := Decode(thread, []byte(str), &DecodeOptions{
+		Object: object,
+		Array:  array,
+		Number: number,
+		Schema: schema,
+	})
 	if err != nil {
 		return nil, fmt.Errorf("%s: %v", b.Name(), err)
 	}
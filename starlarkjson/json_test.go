@@ -0,0 +1,38 @@
+// Copyright 2019 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkjson_test
+
+import (
+	"fmt"
+	"testing"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkjson"
+	"go.starlark.net/starlarktest"
+)
+
+// TestConformance runs the test cases in testdata/json.star, which
+// exercise the decoder's scanner (round-tripping, arbitrary-precision
+// integers, surrogate pairs, malformed input) and the encoder's cycle
+// detection.
+func TestConformance(t *testing.T) {
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	predeclared := starlark.StringDict{"json": starlarkjson.Module}
+	_, err := starlark.ExecFile(thread, "testdata/json.star", nil, predeclared)
+	if err != nil {
+		if err, ok := err.(*starlark.EvalError); ok {
+			t.Fatal(err.Backtrace())
+		}
+		t.Fatal(err)
+	}
+}
+
+func load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	if module == "assert.star" {
+		return starlarktest.LoadAssertModule()
+	}
+	return nil, fmt.Errorf("load not implemented for module %q", module)
+}